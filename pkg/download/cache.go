@@ -0,0 +1,107 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+)
+
+// ErrNotModified is returned by Download and Decompress when caching is
+// enabled (via WithCaching) and the server reports, via a conditional
+// request, that the resource hasn't changed since the last successful
+// download. No file is written or modified in this case.
+var ErrNotModified = errors.New("download: not modified")
+
+// cacheMetadata is the sidecar file (path + ".meta.json") that lets
+// subsequent calls make a conditional request instead of always
+// re-downloading and re-parsing the (possibly multi-hundred-MB) resource.
+type cacheMetadata struct {
+	ETag          string `json:"etag,omitempty"`
+	LastModified  string `json:"last_modified,omitempty"`
+	ContentLength int64  `json:"content_length,omitempty"`
+	// SHA256 is the digest of the decompressed file written to path.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+func metaPath(path string) string {
+	return path + ".meta.json"
+}
+
+func loadCacheMetadata(path string) *cacheMetadata {
+	data, err := ioutil.ReadFile(metaPath(path))
+	if err != nil {
+		return nil
+	}
+	var m cacheMetadata
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil
+	}
+	return &m
+}
+
+func saveCacheMetadata(path string, m cacheMetadata) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(metaPath(path), data, 0o644)
+}
+
+// checkModifiedResult is what checkModified learns from its single
+// conditional HEAD request.
+type checkModifiedResult struct {
+	// modified is false only when the server responds 304 Not Modified, in
+	// which case the remaining fields are unset and the caller must not
+	// touch path.
+	modified     bool
+	etag         string
+	lastModified string
+	// probe is the same information fetchRaw would otherwise have to make a
+	// second HEAD request to learn; pass it to fetchRaw to avoid that.
+	probe probeResult
+}
+
+// checkModified makes a conditional HEAD request for u, replaying any
+// validators previously saved for path.
+func checkModified(ctx context.Context, client *http.Client, u *url.URL, path string) (checkModifiedResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return checkModifiedResult{}, err
+	}
+
+	if meta := loadCacheMetadata(path); meta != nil {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return checkModifiedResult{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return checkModifiedResult{modified: false}, nil
+	}
+
+	return checkModifiedResult{
+		modified:     true,
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		probe: probeResult{
+			size: resp.ContentLength,
+			info: sourceInfo{
+				ContentType:     resp.Header.Get("Content-Type"),
+				ContentEncoding: resp.Header.Get("Content-Encoding"),
+			},
+			acceptsRanges: resp.Header.Get("Accept-Ranges") == "bytes",
+		},
+	}, nil
+}
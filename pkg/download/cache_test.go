@@ -0,0 +1,118 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheMetadataRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "feed.json")
+
+	assert.Nil(t, loadCacheMetadata(path), "no metadata should exist yet")
+
+	m := cacheMetadata{ETag: `"abc123"`, LastModified: "Fri, 01 Jan 2026 00:00:00 GMT", ContentLength: 42, SHA256: "deadbeef"}
+	require.NoError(t, saveCacheMetadata(path, m))
+
+	got := loadCacheMetadata(path)
+	require.NotNil(t, got)
+	assert.Equal(t, m, *got)
+}
+
+func TestCheckModified(t *testing.T) {
+	t.Run("no prior metadata sends no validators and reports modified", func(t *testing.T) {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Empty(t, r.Header.Get("If-None-Match"))
+			assert.Empty(t, r.Header.Get("If-Modified-Since"))
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Last-Modified", "Fri, 01 Jan 2026 00:00:00 GMT")
+		}))
+		defer srv.Close()
+
+		u, err := url.Parse(srv.URL)
+		require.NoError(t, err)
+
+		result, err := checkModified(context.Background(), srv.Client(), u, filepath.Join(t.TempDir(), "feed.json"))
+		require.NoError(t, err)
+		assert.True(t, result.modified)
+		assert.Equal(t, `"v1"`, result.etag)
+		assert.Equal(t, "Fri, 01 Jan 2026 00:00:00 GMT", result.lastModified)
+	})
+
+	t.Run("prior metadata is replayed as conditional headers", func(t *testing.T) {
+		var gotIfNoneMatch, gotIfModifiedSince string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotIfNoneMatch = r.Header.Get("If-None-Match")
+			gotIfModifiedSince = r.Header.Get("If-Modified-Since")
+			w.WriteHeader(http.StatusNotModified)
+		}))
+		defer srv.Close()
+
+		u, err := url.Parse(srv.URL)
+		require.NoError(t, err)
+
+		path := filepath.Join(t.TempDir(), "feed.json")
+		require.NoError(t, saveCacheMetadata(path, cacheMetadata{ETag: `"v1"`, LastModified: "Fri, 01 Jan 2026 00:00:00 GMT"}))
+
+		result, err := checkModified(context.Background(), srv.Client(), u, path)
+		require.NoError(t, err)
+		assert.False(t, result.modified)
+		assert.Empty(t, result.etag)
+		assert.Empty(t, result.lastModified)
+		assert.Zero(t, result.probe.size)
+		assert.Equal(t, `"v1"`, gotIfNoneMatch)
+		assert.Equal(t, "Fri, 01 Jan 2026 00:00:00 GMT", gotIfModifiedSince)
+	})
+}
+
+func TestCheckModifiedCarriesProbeResult(t *testing.T) {
+	const body = "vulnerability feed contents"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	result, err := checkModified(context.Background(), srv.Client(), u, filepath.Join(t.TempDir(), "feed.json"))
+	require.NoError(t, err)
+	assert.True(t, result.modified)
+	assert.True(t, result.probe.acceptsRanges, "fetchRaw must learn Accept-Ranges from the same HEAD, without probing again")
+	assert.Equal(t, "application/json", result.probe.info.ContentType)
+	assert.EqualValues(t, len(body), result.probe.size)
+}
+
+func TestDownloadWithCachingReturnsErrNotModified(t *testing.T) {
+	const body = "vulnerability feed contents"
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL + "/feed.json")
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "feed.json")
+
+	require.NoError(t, Download(context.Background(), srv.Client(), u, path, WithCaching()))
+	assert.FileExists(t, path)
+
+	err = Download(context.Background(), srv.Client(), u, path, WithCaching())
+	assert.ErrorIs(t, err, ErrNotModified)
+}
@@ -0,0 +1,131 @@
+package download
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+// peekSize is how many bytes of the raw stream are inspected for a
+// decompressor's magic number before falling back to header/extension hints.
+const peekSize = 16
+
+// Decompressor wraps r with a decompressing reader. The returned
+// io.ReadCloser's Close must release any resources it holds; it does not
+// close r.
+type Decompressor func(r io.Reader) (io.ReadCloser, error)
+
+type decompressorEntry struct {
+	magic        []byte
+	decompressor Decompressor
+}
+
+var (
+	byMagic []decompressorEntry
+	byHint  = map[string]Decompressor{}
+)
+
+// RegisterDecompressor registers a Decompressor for ext (a file extension
+// or header token, without a leading dot, e.g. "gz", "gzip", "x-gzip").
+// magic, if non-empty, is the byte sequence that identifies the format at
+// the start of a stream; formats registered with a magic number are tried,
+// in registration order, before falling back to Content-Encoding,
+// Content-Type, and finally the URL's file extension.
+func RegisterDecompressor(ext string, magic []byte, decompressor Decompressor) {
+	ext = strings.ToLower(strings.TrimPrefix(ext, "."))
+	byHint[ext] = decompressor
+	if len(magic) > 0 {
+		byMagic = append(byMagic, decompressorEntry{magic: magic, decompressor: decompressor})
+	}
+}
+
+func init() {
+	RegisterDecompressor("gz", []byte{0x1f, 0x8b}, func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	})
+	RegisterDecompressor("gzip", nil, byHint["gz"])
+	RegisterDecompressor("x-gzip", nil, byHint["gz"])
+
+	RegisterDecompressor("bz2", []byte("BZh"), func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	})
+	RegisterDecompressor("bzip2", nil, byHint["bz2"])
+	RegisterDecompressor("x-bzip2", nil, byHint["bz2"])
+
+	RegisterDecompressor("xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, func(r io.Reader) (io.ReadCloser, error) {
+		xzr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(xzr), nil
+	})
+	RegisterDecompressor("x-xz", nil, byHint["xz"])
+
+	RegisterDecompressor("zst", []byte{0x28, 0xb5, 0x2f, 0xfd}, func(r io.Reader) (io.ReadCloser, error) {
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	})
+	RegisterDecompressor("zstd", nil, byHint["zst"])
+
+	RegisterDecompressor("lz4", []byte{0x04, 0x22, 0x4d, 0x18}, func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(lz4.NewReader(r)), nil
+	})
+	RegisterDecompressor("x-lz4", nil, byHint["lz4"])
+}
+
+// selectDecompressor peeks at the start of r to detect a known compression
+// format by magic number, falling back to the Content-Encoding and
+// Content-Type hints from info, and finally to u's file extension. If
+// nothing matches, it returns r unmodified (wrapped to satisfy
+// io.ReadCloser) so the raw bytes are copied through as-is.
+func selectDecompressor(u *url.URL, info sourceInfo, r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReaderSize(r, peekSize)
+	peek, _ := br.Peek(peekSize)
+
+	for _, e := range byMagic {
+		if bytes.HasPrefix(peek, e.magic) {
+			return e.decompressor(br)
+		}
+	}
+
+	for _, hint := range []string{info.ContentEncoding, info.ContentType} {
+		if d := lookupHint(hint); d != nil {
+			return d(br)
+		}
+	}
+
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(u.Path), "."))
+	if d, ok := byHint[ext]; ok {
+		return d(br)
+	}
+
+	return ioutil.NopCloser(br), nil
+}
+
+// lookupHint matches a Content-Encoding/Content-Type header value against
+// the registered hint tokens, e.g. "application/gzip" or "gzip, deflate".
+func lookupHint(header string) Decompressor {
+	header = strings.ToLower(header)
+	if header == "" {
+		return nil
+	}
+	for ext, d := range byHint {
+		if strings.Contains(header, ext) {
+			return d
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package download
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipBytes(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	_, err := gw.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func TestSelectDecompressorMagicByte(t *testing.T) {
+	const want = "vulnerability feed contents"
+	u, err := url.Parse("https://example.com/feed.bin") // extension deliberately doesn't match
+	require.NoError(t, err)
+
+	rc, err := selectDecompressor(u, sourceInfo{}, bytes.NewReader(gzipBytes(t, want)))
+	require.NoError(t, err)
+	defer rc.Close()
+
+	got, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(got))
+}
+
+func TestSelectDecompressorContentEncodingHint(t *testing.T) {
+	const want = "vulnerability feed contents"
+	u, err := url.Parse("https://example.com/feed.bin")
+	require.NoError(t, err)
+
+	// Registered without a magic number, and the body has none, so only the
+	// Content-Encoding hint can select it.
+	called := false
+	RegisterDecompressor("x-enctest", nil, func(r io.Reader) (io.ReadCloser, error) {
+		called = true
+		return ioutil.NopCloser(r), nil
+	})
+
+	rc, err := selectDecompressor(u, sourceInfo{ContentEncoding: "x-enctest"}, bytes.NewReader([]byte(want)))
+	require.NoError(t, err)
+	defer rc.Close()
+
+	got, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(got))
+	assert.True(t, called, "the decompressor named by Content-Encoding must be used")
+}
+
+func TestSelectDecompressorExtensionFallback(t *testing.T) {
+	const want = "vulnerability feed contents"
+	u, err := url.Parse("https://example.com/feed.exttest")
+	require.NoError(t, err)
+
+	// Registered without a magic number, and there are no header hints, so
+	// only the URL's file extension can select it.
+	called := false
+	RegisterDecompressor("exttest", nil, func(r io.Reader) (io.ReadCloser, error) {
+		called = true
+		return ioutil.NopCloser(r), nil
+	})
+
+	rc, err := selectDecompressor(u, sourceInfo{}, bytes.NewReader([]byte(want)))
+	require.NoError(t, err)
+	defer rc.Close()
+
+	got, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(got))
+	assert.True(t, called, "the decompressor registered for the URL's extension must be used")
+}
+
+func TestSelectDecompressorNoMatchPassesThrough(t *testing.T) {
+	const want = "plain, uncompressed contents"
+	u, err := url.Parse("https://example.com/feed.json")
+	require.NoError(t, err)
+
+	rc, err := selectDecompressor(u, sourceInfo{}, bytes.NewReader([]byte(want)))
+	require.NoError(t, err)
+	defer rc.Close()
+
+	got, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(got))
+}
+
+// TestSelectDecompressorMagicPrecedence guards against magic-byte collisions:
+// a format registered with a magic number must be matched on the stream's
+// actual bytes even when the URL extension or header hints would have
+// pointed at a different (wrong) registered format.
+func TestSelectDecompressorMagicPrecedence(t *testing.T) {
+	const want = "vulnerability feed contents"
+	u, err := url.Parse("https://example.com/feed.zst") // extension says zstd, bytes say gzip
+	require.NoError(t, err)
+
+	rc, err := selectDecompressor(u, sourceInfo{ContentEncoding: "zstd"}, bytes.NewReader(gzipBytes(t, want)))
+	require.NoError(t, err)
+	defer rc.Close()
+
+	got, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(got))
+}
+
+func TestLookupHint(t *testing.T) {
+	assert.NotNil(t, lookupHint("application/gzip"))
+	assert.NotNil(t, lookupHint("gzip, deflate"))
+	assert.Nil(t, lookupHint(""))
+	assert.Nil(t, lookupHint("application/json"))
+}
+
+func TestRegisterDecompressorLowercasesAndStripsDot(t *testing.T) {
+	called := false
+	RegisterDecompressor(".CUSTOM", nil, func(r io.Reader) (io.ReadCloser, error) {
+		called = true
+		return ioutil.NopCloser(r), nil
+	})
+
+	d, ok := byHint["custom"]
+	require.True(t, ok)
+	_, err := d(bytes.NewReader(nil))
+	require.NoError(t, err)
+	assert.True(t, called)
+}
@@ -2,23 +2,185 @@
 package download
 
 import (
-	"compress/bzip2"
-	"compress/gzip"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	pathutil "path"
 	"path/filepath"
 	"strings"
+)
+
+// ChecksumAlgorithm identifies a supported digest algorithm for verifying
+// the integrity of a downloaded file.
+type ChecksumAlgorithm string
 
-	"github.com/ulikunitz/xz"
+// Supported checksum algorithms.
+const (
+	SHA256 ChecksumAlgorithm = "sha256"
+	SHA512 ChecksumAlgorithm = "sha512"
 )
 
-// Download downloads a file from a URL and writes it to path. If the url ends in .gz, .bz2, or .xz,
-// it will be decompressed before writing.
-func Download(client *http.Client, u *url.URL, path string) error {
+func (a ChecksumAlgorithm) new() (hash.Hash, error) {
+	switch a {
+	case SHA256, "":
+		return sha256.New(), nil
+	case SHA512:
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm: %s", a)
+	}
+}
+
+// ChecksumSpec describes how to verify the integrity of a downloaded file
+// before it is persisted to its final path.
+//
+// The digest is computed over the raw bytes as sent by the server, before
+// any decompression is applied.
+type ChecksumSpec struct {
+	// Algorithm is the digest algorithm to use. Defaults to SHA256.
+	Algorithm ChecksumAlgorithm
+	// Digest is the expected digest of the downloaded file, hex- or
+	// base64-encoded. Ignored if ManifestURL is set.
+	Digest string
+	// ManifestURL, if set, points to a SHA256SUMS-style manifest (lines of
+	// "<hex digest>  <filename>"). The entry whose filename matches the last
+	// path segment of the download URL is used as the expected digest.
+	ManifestURL string
+}
+
+// SignatureSpec describes how to verify the authenticity of a downloaded
+// file using a detached ed25519 signature. The signature file must hold the
+// raw 64-byte signature; minisign's text signature format is not parsed.
+type SignatureSpec struct {
+	// URL is the location of the detached signature. If empty, the
+	// downloaded URL with a ".sig" suffix appended is used.
+	URL string
+	// PublicKey is the raw ed25519 public key used to verify the signature.
+	PublicKey ed25519.PublicKey
+}
+
+// Options configures a call to Download or Decompress: integrity and
+// authenticity checks, and how the underlying transfer is performed.
+type Options struct {
+	Checksum  *ChecksumSpec
+	Signature *SignatureSpec
+
+	// Progress, if set, is called as the transfer makes progress.
+	Progress ProgressFunc
+	// Concurrency is the number of concurrent byte-range requests to use
+	// when the server supports them. Defaults to 4.
+	Concurrency int
+	// Retry configures backoff for transient transfer errors. The zero
+	// value uses sane defaults.
+	Retry RetryPolicy
+
+	// Cache enables conditional GET caching: see WithCaching.
+	Cache bool
+}
+
+// Option configures a call to Download or Decompress. It returns an error if
+// the option's value is invalid.
+type Option func(*Options) error
+
+// WithChecksum verifies the downloaded file against spec before it is
+// persisted to its destination path.
+func WithChecksum(spec ChecksumSpec) Option {
+	return func(o *Options) error {
+		o.Checksum = &spec
+		return nil
+	}
+}
+
+// WithSignature verifies the downloaded file against a detached signature
+// before it is persisted to its destination path.
+func WithSignature(spec SignatureSpec) Option {
+	return func(o *Options) error {
+		o.Signature = &spec
+		return nil
+	}
+}
+
+// WithProgress reports transfer progress via fn.
+func WithProgress(fn ProgressFunc) Option {
+	return func(o *Options) error {
+		o.Progress = fn
+		return nil
+	}
+}
+
+// WithConcurrency sets the number of concurrent byte-range requests to use
+// when the server supports them. n must be positive.
+func WithConcurrency(n int) Option {
+	return func(o *Options) error {
+		if n <= 0 {
+			return fmt.Errorf("download: concurrency must be positive, got %d", n)
+		}
+		o.Concurrency = n
+		return nil
+	}
+}
+
+// WithRetryPolicy overrides the default retry/backoff behavior used for
+// transient transfer errors.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(o *Options) error {
+		o.Retry = p
+		return nil
+	}
+}
+
+// WithCaching enables conditional GET caching. Validators (ETag,
+// Last-Modified) from a previous successful download are persisted
+// alongside path and replayed as If-None-Match/If-Modified-Since on the
+// next call; if the server responds 304 Not Modified, Download/Decompress
+// return ErrNotModified without touching path.
+func WithCaching() Option {
+	return func(o *Options) error {
+		o.Cache = true
+		return nil
+	}
+}
+
+// Download downloads a file from a URL and writes it to path, decompressing it along the way if a
+// registered format is detected (see RegisterDecompressor) from the stream's magic number, the
+// response's Content-Encoding/Content-Type, or finally the URL's file extension. The transfer is
+// split into concurrent, resumable byte-range requests when the server supports them, with
+// exponential backoff retries on transient errors; ctx governs cancellation of the whole operation.
+// If opts include a ChecksumSpec and/or SignatureSpec, the raw (pre-decompression) bytes are
+// verified before the file is moved to path; on failure the temporary file is removed and path is
+// left untouched.
+//
+// Callers that only need to parse the result once, without a tempfile round-trip, can use Fetch
+// instead; DownloadTo writes Fetch's single streamed request to path.
+func Download(ctx context.Context, client *http.Client, u *url.URL, path string, opts ...Option) error {
+	return download(ctx, client, u, path, opts)
+}
+
+// Decompress is a deprecated alias for Download; the two have always behaved identically.
+//
+// Deprecated: use Download instead.
+func Decompress(ctx context.Context, client *http.Client, u *url.URL, path string, opts ...Option) error {
+	return Download(ctx, client, u, path, opts...)
+}
+
+func download(ctx context.Context, client *http.Client, u *url.URL, path string, opts []Option) error {
+	var options Options
+	for _, opt := range opts {
+		if err := opt(&options); err != nil {
+			return err
+		}
+	}
 
 	// atomically write to file
 	dir, file := filepath.Split(path)
@@ -34,6 +196,46 @@ func Download(client *http.Client, u *url.URL, path string) error {
 		return err
 	}
 
+	var cacheMeta cacheMetadata
+	var pre *probeResult
+	if options.Cache {
+		result, err := checkModified(ctx, client, u, path)
+		if err != nil {
+			return err
+		}
+		if !result.modified {
+			return ErrNotModified
+		}
+		cacheMeta = cacheMetadata{ETag: result.etag, LastModified: result.lastModified, ContentLength: result.probe.size}
+		pre = &result.probe
+	}
+
+	// Fetch the raw, pre-decompression bytes to a stable path next to the
+	// destination first: ranged transfers write out of order via WriteAt, so
+	// there's no single ordered stream to decompress or verify on the fly.
+	// Keeping the path stable (rather than a fresh tempfile per call) is what
+	// lets an interrupted ranged transfer be resumed by a later call.
+	rawPath := filepath.Join(dir, file+".download")
+	rawDone := false
+	defer func() {
+		if rawDone {
+			os.Remove(rawPath)
+			removeTransferState(rawPath)
+		}
+	}()
+
+	info, err := fetchRaw(ctx, client, u, rawPath, options, pre)
+	if err != nil {
+		return err
+	}
+
+	if options.Checksum != nil || options.Signature != nil {
+		if err := verifyFile(client, u, options, rawPath); err != nil {
+			rawDone = true
+			return err
+		}
+	}
+
 	tmpFile, err := ioutil.TempFile(dir, file)
 	if err != nil {
 		return fmt.Errorf("create temporary file: %w", err)
@@ -48,37 +250,24 @@ func Download(client *http.Client, u *url.URL, path string) error {
 		}
 	}()
 
-	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	rawIn, err := os.Open(rawPath)
 	if err != nil {
 		return err
 	}
+	defer rawIn.Close()
 
-	resp, err := client.Do(req)
+	decompressor, err := selectDecompressor(u, info, rawIn)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	defer decompressor.Close()
 
-	r := io.Reader(resp.Body)
+	r := io.Reader(decompressor)
 
-	// decompress (optional)
-	switch {
-	case strings.HasSuffix(u.Path, "gz"):
-		gr, err := gzip.NewReader(resp.Body)
-		if err != nil {
-			return err
-		}
-		r = gr
-	case strings.HasSuffix(u.Path, "bz2"):
-		r = bzip2.NewReader(resp.Body)
-	case strings.HasSuffix(u.Path, "xz"):
-		xzr, err := xz.NewReader(resp.Body)
-		if err != nil {
-			return err
-		}
-		r = xzr
-	default:
-		// don't decompress
+	var decompressedHash hash.Hash
+	if options.Cache {
+		decompressedHash = sha256.New()
+		r = io.TeeReader(r, decompressedHash)
 	}
 
 	if _, err := io.Copy(tmpFile, r); err != nil {
@@ -95,89 +284,143 @@ func Download(client *http.Client, u *url.URL, path string) error {
 	}
 
 	moved = true
+	rawDone = true
+
+	if options.Cache {
+		cacheMeta.SHA256 = fmt.Sprintf("%x", decompressedHash.Sum(nil))
+		if err := saveCacheMetadata(path, cacheMeta); err != nil {
+			return fmt.Errorf("save cache metadata: %w", err)
+		}
+	}
 
 	return nil
 }
 
-// Decompress downloads a file from a URL and writes it to path. If the url ends in .gz, .bz2, or .xz,
-// it will be decompressed before writing.
-func Decompress(client *http.Client, u *url.URL, path string) error {
-
-	// atomically write to file
-	dir, file := filepath.Split(path)
-	if dir == "" {
-		// If the file is in the current working directory, then dir will be "".
-		// However, this means that ioutil.TempFile will use the default directory
-		// for temporary files, which is wrong.
-		dir = "."
-	}
-
-	// ensure dir exists
-	if err := os.MkdirAll(dir, 0o755); err != nil {
-		return err
+// verifyFile checks the raw downloaded bytes at rawPath against the checksum and/or signature
+// configured in options.
+func verifyFile(client *http.Client, u *url.URL, options Options, rawPath string) error {
+	if options.Checksum != nil {
+		if err := verifyChecksum(client, u, options.Checksum, rawPath); err != nil {
+			return err
+		}
 	}
 
-	tmpFile, err := ioutil.TempFile(dir, file)
-	if err != nil {
-		return fmt.Errorf("create temporary file: %w", err)
+	if options.Signature != nil {
+		if err := verifySignature(client, u, options.Signature, rawPath); err != nil {
+			return err
+		}
 	}
-	defer tmpFile.Close() // ignore err from closing twice
 
-	// Clean up tmp file if not moved
-	moved := false
-	defer func() {
-		if !moved {
-			os.Remove(tmpFile.Name())
-		}
-	}()
+	return nil
+}
 
-	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+// verifyChecksum hashes rawPath from disk, without buffering it in memory, and compares the
+// digest against spec.
+func verifyChecksum(client *http.Client, u *url.URL, spec *ChecksumSpec, rawPath string) error {
+	h, err := spec.Algorithm.new()
 	if err != nil {
 		return err
 	}
 
-	resp, err := client.Do(req)
+	f, err := os.Open(rawPath)
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	defer f.Close()
 
-	r := io.Reader(resp.Body)
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
 
-	// decompress (optional)
-	switch {
-	case strings.HasSuffix(u.Path, "gz"):
-		gr, err := gzip.NewReader(resp.Body)
+	expected := spec.Digest
+	if spec.ManifestURL != "" {
+		expected, err = fetchManifestDigest(client, spec.ManifestURL, pathutil.Base(u.Path))
 		if err != nil {
-			return err
+			return fmt.Errorf("fetch checksum manifest: %w", err)
 		}
-		r = gr
-	case strings.HasSuffix(u.Path, "bz2"):
-		r = bzip2.NewReader(resp.Body)
-	case strings.HasSuffix(u.Path, "xz"):
-		xzr, err := xz.NewReader(resp.Body)
-		if err != nil {
-			return err
-		}
-		r = xzr
-	default:
-		// don't decompress
 	}
-
-	if _, err := io.Copy(tmpFile, r); err != nil {
+	want, err := decodeDigest(expected)
+	if err != nil {
 		return err
 	}
+	if got := h.Sum(nil); !bytes.Equal(got, want) {
+		return fmt.Errorf("checksum mismatch for %s: expected %x, got %x", u, want, got)
+	}
 
-	// Writes are not synchronous. Handle errors from writes returned by Close.
-	if err := tmpFile.Close(); err != nil {
-		return fmt.Errorf("write and close temporary file: %w", err)
+	return nil
+}
+
+// decodeDigest decodes a hex- or base64-encoded digest, trying hex first
+// since manifest entries (SHA256SUMS-style) are always hex.
+func decodeDigest(s string) ([]byte, error) {
+	if b, err := hex.DecodeString(s); err == nil {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	if b, err := base64.RawStdEncoding.DecodeString(s); err == nil {
+		return b, nil
 	}
+	return nil, fmt.Errorf("digest %q is neither valid hex nor base64", s)
+}
 
-	if err := os.Rename(tmpFile.Name(), path); err != nil {
+// verifySignature reads rawPath fully into memory, since ed25519.Verify needs the whole message at
+// once, and checks it against the detached signature described by spec.
+func verifySignature(client *http.Client, u *url.URL, spec *SignatureSpec, rawPath string) error {
+	raw, err := ioutil.ReadFile(rawPath)
+	if err != nil {
 		return err
 	}
 
-	moved = true
+	sigURL := spec.URL
+	if sigURL == "" {
+		sigURL = u.String() + ".sig"
+	}
+	sig, err := fetchAll(client, sigURL)
+	if err != nil {
+		return fmt.Errorf("fetch signature: %w", err)
+	}
+	if !ed25519.Verify(spec.PublicKey, raw, sig) {
+		return fmt.Errorf("signature verification failed for %s", u)
+	}
 
 	return nil
 }
+
+// fetchManifestDigest downloads a SHA256SUMS-style manifest and returns the
+// digest for the entry matching filename.
+func fetchManifestDigest(client *http.Client, manifestURL, filename string) (string, error) {
+	body, err := fetchAll(client, manifestURL)
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if strings.TrimPrefix(fields[1], "*") == filename {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("no entry for %q in manifest %s", filename, manifestURL)
+}
+
+func fetchAll(client *http.Client, u string) ([]byte, error) {
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d fetching %s", resp.StatusCode, u)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
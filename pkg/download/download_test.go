@@ -0,0 +1,92 @@
+package download
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadChecksumVerification(t *testing.T) {
+	const body = "vulnerability feed contents"
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(body)))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		fmt.Fprint(w, body)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL + "/feed.json")
+	require.NoError(t, err)
+
+	t.Run("matching digest succeeds", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "feed.json")
+		err := Download(context.Background(), srv.Client(), u, path, WithChecksum(ChecksumSpec{Digest: digest}))
+		require.NoError(t, err)
+		assert.FileExists(t, path)
+	})
+
+	t.Run("mismatched digest fails and leaves no file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "feed.json")
+		err := Download(context.Background(), srv.Client(), u, path, WithChecksum(ChecksumSpec{Digest: "deadbeef"}))
+		require.Error(t, err)
+		_, statErr := os.Stat(path)
+		assert.True(t, os.IsNotExist(statErr))
+	})
+
+	t.Run("base64-encoded digest is accepted", func(t *testing.T) {
+		sum := sha256.Sum256([]byte(body))
+		path := filepath.Join(t.TempDir(), "feed.json")
+		err := Download(context.Background(), srv.Client(), u, path, WithChecksum(ChecksumSpec{Digest: base64.StdEncoding.EncodeToString(sum[:])}))
+		require.NoError(t, err)
+		assert.FileExists(t, path)
+	})
+}
+
+func TestDownloadSignatureVerification(t *testing.T) {
+	const body = "vulnerability feed contents"
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	sig := ed25519.Sign(priv, []byte(body))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/feed.json.sig" {
+			w.Write(sig)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL + "/feed.json")
+	require.NoError(t, err)
+
+	t.Run("valid signature succeeds", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "feed.json")
+		err := Download(context.Background(), srv.Client(), u, path, WithSignature(SignatureSpec{PublicKey: pub}))
+		require.NoError(t, err)
+		assert.FileExists(t, path)
+	})
+
+	t.Run("wrong public key fails and leaves no file", func(t *testing.T) {
+		otherPub, _, err := ed25519.GenerateKey(nil)
+		require.NoError(t, err)
+
+		path := filepath.Join(t.TempDir(), "feed.json")
+		err = Download(context.Background(), srv.Client(), u, path, WithSignature(SignatureSpec{PublicKey: otherPub}))
+		require.Error(t, err)
+		_, statErr := os.Stat(path)
+		assert.True(t, os.IsNotExist(statErr))
+	})
+}
@@ -0,0 +1,125 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+// Metadata describes a fetched resource, as reported by the server.
+type Metadata struct {
+	ContentLength   int64
+	ContentType     string
+	ContentEncoding string
+}
+
+// Fetch performs a single GET request for u and returns a stream of its
+// (optionally decompressed, see RegisterDecompressor) body along with
+// Metadata, without writing anything to disk. The caller must close the
+// returned io.ReadCloser.
+//
+// Fetch is meant for callers that parse the resource in a single pass (JSON,
+// XML, ...) and don't need a tempfile round-trip; it doesn't support the
+// resumable ranged transfers, checksum/signature verification, or
+// conditional-GET caching that Download and Decompress do. Use DownloadTo,
+// or Download/Decompress, when you need the result on disk.
+func Fetch(ctx context.Context, client *http.Client, u *url.URL) (io.ReadCloser, Metadata, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, Metadata{}, fmt.Errorf("unexpected status %d fetching %s", resp.StatusCode, u)
+	}
+
+	meta := Metadata{
+		ContentLength:   resp.ContentLength,
+		ContentType:     resp.Header.Get("Content-Type"),
+		ContentEncoding: resp.Header.Get("Content-Encoding"),
+	}
+	info := sourceInfo{ContentType: meta.ContentType, ContentEncoding: meta.ContentEncoding}
+
+	decompressor, err := selectDecompressor(u, info, resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, Metadata{}, err
+	}
+
+	return bodyCloser{ReadCloser: decompressor, body: resp.Body}, meta, nil
+}
+
+// bodyCloser closes both the decompressing reader and the underlying
+// response body it wraps.
+type bodyCloser struct {
+	io.ReadCloser
+	body io.ReadCloser
+}
+
+func (b bodyCloser) Close() error {
+	err := b.ReadCloser.Close()
+	if bodyErr := b.body.Close(); err == nil {
+		err = bodyErr
+	}
+	return err
+}
+
+// DownloadTo downloads u via Fetch and atomically writes the resulting
+// (decompressed) stream to path. Unlike Download and Decompress, it always
+// issues a single streamed request: it doesn't split the transfer into
+// resumable byte ranges, verify a checksum/signature, or support conditional
+// caching.
+func DownloadTo(ctx context.Context, client *http.Client, u *url.URL, path string) error {
+	r, _, err := Fetch(ctx, client, u)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	dir, file := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(dir, file)
+	if err != nil {
+		return fmt.Errorf("create temporary file: %w", err)
+	}
+	defer tmpFile.Close() // ignore err from closing twice
+
+	moved := false
+	defer func() {
+		if !moved {
+			os.Remove(tmpFile.Name())
+		}
+	}()
+
+	if _, err := io.Copy(tmpFile, r); err != nil {
+		return err
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("write and close temporary file: %w", err)
+	}
+
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		return err
+	}
+
+	moved = true
+
+	return nil
+}
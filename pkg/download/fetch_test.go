@@ -0,0 +1,107 @@
+package download
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchStreamsWithoutTouchingDisk(t *testing.T) {
+	const want = "vulnerability feed contents"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(want))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL + "/feed.json")
+	require.NoError(t, err)
+
+	r, meta, err := Fetch(context.Background(), srv.Client(), u)
+	require.NoError(t, err)
+	defer r.Close()
+
+	assert.Equal(t, "application/json", meta.ContentType)
+
+	got, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(got))
+}
+
+func TestFetchDecompressesByMagicByte(t *testing.T) {
+	const want = "vulnerability feed contents"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(gzipBytes(t, want))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL + "/feed.bin")
+	require.NoError(t, err)
+
+	r, _, err := Fetch(context.Background(), srv.Client(), u)
+	require.NoError(t, err)
+	defer r.Close()
+
+	got, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(got))
+}
+
+func TestFetchNonOKStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL + "/missing.json")
+	require.NoError(t, err)
+
+	_, _, err = Fetch(context.Background(), srv.Client(), u)
+	require.Error(t, err)
+}
+
+func TestDownloadToWritesAtomically(t *testing.T) {
+	const want = "vulnerability feed contents"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(want))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL + "/feed.json")
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "feed.json")
+	require.NoError(t, DownloadTo(context.Background(), srv.Client(), u, path))
+
+	got, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, want, string(got))
+
+	entries, err := ioutil.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "no leftover temporary files should remain next to the destination")
+}
+
+func TestDownloadToNonOKStatusLeavesNoFile(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL + "/feed.json")
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "feed.json")
+	err = DownloadTo(context.Background(), srv.Client(), u, path)
+	require.Error(t, err)
+
+	_, statErr := ioutil.ReadFile(path)
+	assert.Error(t, statErr)
+}
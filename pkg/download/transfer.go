@@ -0,0 +1,421 @@
+package download
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// ProgressFunc is called as a transfer makes progress. bytesTotal is -1 if
+// the server didn't report a Content-Length.
+type ProgressFunc func(bytesDone, bytesTotal int64)
+
+// RetryPolicy configures exponential backoff retries for transient transfer
+// errors (5xx responses, 429 responses, and network errors).
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts per request, including
+	// the first. Defaults to 5.
+	MaxAttempts int
+	// BaseDelay is the upper bound of the (jittered) delay before the first
+	// retry. Defaults to 500ms.
+	BaseDelay time.Duration
+	// MaxDelay caps the computed backoff delay; a server's Retry-After is
+	// honored as-is and is not capped. Defaults to 30s.
+	MaxDelay time.Duration
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 5,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    30 * time.Second,
+}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = defaultRetryPolicy.MaxAttempts
+	}
+	if p.BaseDelay == 0 {
+		p.BaseDelay = defaultRetryPolicy.BaseDelay
+	}
+	if p.MaxDelay == 0 {
+		p.MaxDelay = defaultRetryPolicy.MaxDelay
+	}
+	return p
+}
+
+// backoff returns how long to wait after the failed attempt (1-indexed)
+// before the next one, honoring a Retry-After header if the server sent one.
+func (p RetryPolicy) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return retryAfter
+	}
+	d := float64(p.BaseDelay) * math.Pow(2, float64(attempt-1))
+	if d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	// full jitter
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+const (
+	// defaultConcurrency is the number of concurrent ranged requests used
+	// when the server supports them.
+	defaultConcurrency = 4
+	// minRangedSize is the smallest content length for which we bother
+	// splitting the transfer into ranges; smaller files aren't worth the
+	// overhead of multiple round trips.
+	minRangedSize = 8 * 1024 * 1024
+)
+
+// transferState is the sidecar ".part" file used to resume an interrupted
+// ranged download. It is removed once the transfer completes successfully.
+type transferState struct {
+	URL    string       `json:"url"`
+	Size   int64        `json:"size"`
+	Ranges []rangeState `json:"ranges"`
+}
+
+type rangeState struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"` // inclusive
+	Done  bool  `json:"done"`
+}
+
+func partPath(rawPath string) string {
+	return rawPath + ".part"
+}
+
+func loadTransferState(rawPath, u string, size int64) *transferState {
+	data, err := ioutil.ReadFile(partPath(rawPath))
+	if err != nil {
+		return nil
+	}
+	var st transferState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil
+	}
+	if st.URL != u || st.Size != size {
+		// Stale state from a different resource; ignore it.
+		return nil
+	}
+	return &st
+}
+
+func saveTransferState(rawPath string, st *transferState) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(partPath(rawPath), data, 0o600)
+}
+
+func removeTransferState(rawPath string) {
+	os.Remove(partPath(rawPath))
+}
+
+// sourceInfo carries the response metadata learned while probing u, used to
+// pick a Decompressor once the raw bytes have been fetched.
+type sourceInfo struct {
+	ContentType     string
+	ContentEncoding string
+}
+
+// probeResult is what a HEAD request learns about a resource before
+// fetching it: its size, whether the server supports range requests, and
+// hints for picking a Decompressor.
+type probeResult struct {
+	size          int64
+	acceptsRanges bool
+	info          sourceInfo
+}
+
+// fetchRaw downloads the raw (pre-decompression) bytes of u into rawPath,
+// splitting the transfer into concurrent byte ranges when the server
+// supports it, and falling back to a single streamed request otherwise. An
+// interrupted ranged transfer can be resumed by calling fetchRaw again with
+// the same rawPath: completed ranges are tracked in a "rawPath.part"
+// sidecar file and are not re-requested.
+//
+// pre, if non-nil, is a probeResult already obtained for u (e.g. by
+// checkModified's conditional HEAD) and is used instead of issuing a second,
+// redundant HEAD request.
+func fetchRaw(ctx context.Context, client *http.Client, u *url.URL, rawPath string, opts Options, pre *probeResult) (sourceInfo, error) {
+	retry := opts.Retry.withDefaults()
+
+	pr := pre
+	if pr == nil {
+		probed, err := probe(ctx, client, u, retry)
+		if err != nil {
+			return sourceInfo{}, fmt.Errorf("probe %s: %w", u, err)
+		}
+		pr = &probed
+	}
+
+	if !pr.acceptsRanges || pr.size < minRangedSize {
+		return pr.info, fetchSequential(ctx, client, u, rawPath, retry, opts.Progress)
+	}
+
+	return pr.info, fetchRanged(ctx, client, u, rawPath, pr.size, retry, opts)
+}
+
+// probe determines the resource size and whether the server supports range
+// requests, via a HEAD request, so that the fallback path (server doesn't
+// support ranges) doesn't pay for downloading the body twice: a HEAD has no
+// body to drain, whereas a GET would have to either discard a full response
+// or be reused awkwardly across the ranged/sequential split. It also
+// captures Content-Type and Content-Encoding as hints for decompressor
+// selection.
+func probe(ctx context.Context, client *http.Client, u *url.URL, retry RetryPolicy) (probeResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return probeResult{}, err
+	}
+
+	resp, err := doWithRetry(ctx, client, req, retry)
+	if err != nil {
+		return probeResult{}, err
+	}
+	defer resp.Body.Close()
+
+	return probeResult{
+		size: resp.ContentLength,
+		info: sourceInfo{
+			ContentType:     resp.Header.Get("Content-Type"),
+			ContentEncoding: resp.Header.Get("Content-Encoding"),
+		},
+		acceptsRanges: resp.Header.Get("Accept-Ranges") == "bytes",
+	}, nil
+}
+
+// fetchSequential streams the whole resource in one request, retrying the
+// request on transient errors until a response arrives (see doWithRetry).
+// An error while copying the response body is returned without a retry.
+func fetchSequential(ctx context.Context, client *http.Client, u *url.URL, rawPath string, retry RetryPolicy, progress ProgressFunc) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := doWithRetry(ctx, client, req, retry)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d fetching %s", resp.StatusCode, u)
+	}
+
+	f, err := os.OpenFile(rawPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = resp.Body
+	if progress != nil {
+		r = &progressReader{r: resp.Body, total: resp.ContentLength, fn: progress}
+	}
+
+	_, err = io.Copy(f, r)
+	return err
+}
+
+// fetchRanged downloads size bytes of u into rawPath using concurrent
+// byte-range requests, resuming from a sidecar state file left by a
+// previous interrupted attempt, if any.
+func fetchRanged(ctx context.Context, client *http.Client, u *url.URL, rawPath string, size int64, retry RetryPolicy, opts Options) error {
+	concurrency := opts.Concurrency
+	switch {
+	case concurrency == 0:
+		concurrency = defaultConcurrency
+	case concurrency < 0:
+		return fmt.Errorf("download: concurrency must be positive, got %d", concurrency)
+	}
+
+	st := loadTransferState(rawPath, u.String(), size)
+	if st == nil {
+		st = &transferState{URL: u.String(), Size: size, Ranges: splitRanges(size, concurrency)}
+	}
+
+	f, err := os.OpenFile(rawPath, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	doneBytes := int64(0)
+	for _, rs := range st.Ranges {
+		if rs.Done {
+			doneBytes += rs.End - rs.Start + 1
+		}
+	}
+	if opts.Progress != nil {
+		opts.Progress(doneBytes, size)
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for i := range st.Ranges {
+		i := i
+		if st.Ranges[i].Done {
+			continue
+		}
+
+		g.Go(func() error {
+			rs := st.Ranges[i]
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", rs.Start, rs.End))
+
+			resp, err := doWithRetry(ctx, client, req, retry)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusPartialContent {
+				return fmt.Errorf("unexpected status %d fetching range %d-%d of %s", resp.StatusCode, rs.Start, rs.End, u)
+			}
+
+			n, err := io.Copy(&sectionWriter{f: f, off: rs.Start}, resp.Body)
+			if err != nil {
+				return err
+			}
+			if want := rs.End - rs.Start + 1; n != want {
+				return fmt.Errorf("short read for range %d-%d: got %d of %d bytes", rs.Start, rs.End, n, want)
+			}
+
+			mu.Lock()
+			st.Ranges[i].Done = true
+			doneBytes += n
+			saveErr := saveTransferState(rawPath, st)
+			progress, total := opts.Progress, doneBytes
+			mu.Unlock()
+
+			if saveErr != nil {
+				return saveErr
+			}
+			if progress != nil {
+				progress(total, size)
+			}
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	removeTransferState(rawPath)
+	return nil
+}
+
+func splitRanges(size int64, n int) []rangeState {
+	chunk := size / int64(n)
+	if chunk == 0 {
+		chunk = size
+		n = 1
+	}
+	ranges := make([]rangeState, 0, n)
+	start := int64(0)
+	for i := 0; i < n; i++ {
+		end := start + chunk - 1
+		if i == n-1 {
+			end = size - 1
+		}
+		ranges = append(ranges, rangeState{Start: start, End: end})
+		start = end + 1
+	}
+	return ranges
+}
+
+// sectionWriter writes sequential Writes into f starting at off.
+type sectionWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (w *sectionWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+// progressReader reports cumulative bytes read via fn as r is consumed.
+type progressReader struct {
+	r     io.Reader
+	total int64
+	done  int64
+	fn    ProgressFunc
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.done += int64(n)
+		p.fn(p.done, p.total)
+	}
+	return n, err
+}
+
+// doWithRetry executes req, retrying on network errors, 429, and 5xx
+// responses with exponential backoff and jitter, honoring Retry-After.
+func doWithRetry(ctx context.Context, client *http.Client, req *http.Request, retry RetryPolicy) (*http.Response, error) {
+	var lastErr error
+	for attempt := 1; attempt <= retry.MaxAttempts; attempt++ {
+		resp, err := client.Do(req.Clone(ctx))
+		if err == nil && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+			return resp, nil
+		}
+
+		var retryAfter time.Duration
+		if err != nil {
+			lastErr = err
+		} else {
+			lastErr = fmt.Errorf("unexpected status %d fetching %s", resp.StatusCode, req.URL)
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+			resp.Body.Close()
+		}
+
+		if attempt == retry.MaxAttempts {
+			break
+		}
+
+		select {
+		case <-time.After(retry.backoff(attempt, retryAfter)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, fmt.Errorf("giving up after %d attempts: %w", retry.MaxAttempts, lastErr)
+}
+
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
@@ -0,0 +1,164 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitRanges(t *testing.T) {
+	cases := []struct {
+		name string
+		size int64
+		n    int
+		want []rangeState
+	}{
+		{"even split", 100, 4, []rangeState{{Start: 0, End: 24}, {Start: 25, End: 49}, {Start: 50, End: 74}, {Start: 75, End: 99}}},
+		{"uneven split", 10, 3, []rangeState{{Start: 0, End: 2}, {Start: 3, End: 5}, {Start: 6, End: 9}}},
+		{"n larger than size", 2, 8, []rangeState{{Start: 0, End: 1}}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := splitRanges(c.size, c.n)
+			assert.Equal(t, c.want, got)
+
+			var total int64
+			for _, r := range got {
+				total += r.End - r.Start + 1
+			}
+			assert.Equal(t, c.size, total, "ranges must cover the whole resource with no gaps or overlaps")
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 5, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+
+	d := p.backoff(10, 0)
+	assert.LessOrEqual(t, d, p.MaxDelay, "backoff must never exceed MaxDelay")
+	assert.GreaterOrEqual(t, d, time.Duration(0))
+
+	retryAfter := 42 * time.Second
+	assert.Equal(t, retryAfter, p.backoff(1, retryAfter), "an explicit Retry-After must be honored as-is")
+}
+
+func TestRetryPolicyWithDefaults(t *testing.T) {
+	got := RetryPolicy{}.withDefaults()
+	assert.Equal(t, defaultRetryPolicy, got)
+
+	got = RetryPolicy{MaxAttempts: 9}.withDefaults()
+	assert.Equal(t, 9, got.MaxAttempts)
+	assert.Equal(t, defaultRetryPolicy.BaseDelay, got.BaseDelay)
+}
+
+func TestDoWithRetryRetriesTransientErrors(t *testing.T) {
+	var attempts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+
+	resp, err := doWithRetry(context.Background(), srv.Client(), req, RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestDoWithRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	var attempts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+
+	_, err = doWithRetry(context.Background(), srv.Client(), req, RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond})
+	require.Error(t, err)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestTransferStateRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	rawPath := dir + "/feed.xml.download"
+
+	st := &transferState{URL: "https://example.com/feed.xml", Size: 100, Ranges: splitRanges(100, 4)}
+	st.Ranges[0].Done = true
+	require.NoError(t, saveTransferState(rawPath, st))
+
+	loaded := loadTransferState(rawPath, st.URL, st.Size)
+	require.NotNil(t, loaded)
+	assert.Equal(t, st, loaded)
+
+	// A mismatched URL or size indicates a different resource; the state must be ignored.
+	assert.Nil(t, loadTransferState(rawPath, "https://example.com/other.xml", st.Size))
+	assert.Nil(t, loadTransferState(rawPath, st.URL, st.Size+1))
+
+	removeTransferState(rawPath)
+	assert.Nil(t, loadTransferState(rawPath, st.URL, st.Size))
+}
+
+func TestDownloadSequentialNonOKStatusLeavesNoFile(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("<html>not found</html>"))
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL + "/feed.json")
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "feed.json")
+	err = Download(context.Background(), srv.Client(), u, path)
+	require.Error(t, err)
+
+	_, statErr := os.Stat(path)
+	assert.True(t, os.IsNotExist(statErr), "a non-OK response must not be persisted to path")
+}
+
+func TestDownloadRangedNonPartialContentStatusLeavesNoFile(t *testing.T) {
+	size := minRangedSize + 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", strconv.Itoa(size))
+			return
+		}
+		// Misbehaving server: claims range support but answers every ranged
+		// GET with 404 instead of 206.
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL + "/feed.bin")
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "feed.bin")
+	err = Download(context.Background(), srv.Client(), u, path)
+	require.Error(t, err)
+
+	_, statErr := os.Stat(path)
+	assert.True(t, os.IsNotExist(statErr), "a non-206 ranged response must not be persisted to path")
+}